@@ -13,16 +13,15 @@ package art
 
 import (
 	"encoding/binary"
+	"iter"
 
 	"inet.af/netaddr"
 )
 
-// TODO: section 3.1: Element Consolidation. We currently store 3
-// words (2 for the Route interface, 1 for the *Table) per entry; the
-// paper does 1. Without doing unsafe, we could get at least down to 2
-// by making a child *Table type that implements Route.
-
-// TODO: section 3.2: path compression.
+// TODO: section 3.1: Element Consolidation. We currently store 2
+// words (1 for the *entry, 1 for the *tableNode) per entry; the
+// paper does 1. Without doing unsafe, we could get down to 1 by
+// making a child *Table type that doubles as the entry.
 
 func baseIndex(width int, addr uint32, prefixLen int) uint32 {
 	return (addr >> uint32(width-prefixLen)) | (1 << uint32(prefixLen))
@@ -82,50 +81,164 @@ func getBits16(byteOffset, bits int, from [16]byte) uint32 {
 	return v & ((1 << bits) - 1)
 }
 
-// A Route is an entry in the routing table.
-type Route interface {
-	// IPPrefix returns the IP and Prefix of the routing table entry.
-	IPPrefix() netaddr.IPPrefix
-	// Equals is a way to compare two routes. Even if they contain the same IPPrefix,
-	// if there is additional metadata that can be compared here.
-	Equals(Route) bool
+// extractBits returns the `width` bits of ip's address starting at bit offset ss (0 being the
+// most significant bit), where w is the total address width (32 or 128). It takes the fast,
+// byte-oriented path when the window is byte aligned (true of every window within the table's
+// configured strides), and falls back to bitsAt otherwise (true of windows a path-compression
+// split has created, which need not be byte aligned).
+func extractBits(ip netaddr.IP, w, ss, width int) uint32 {
+	end := ss + width
+	if ss%8 == 0 && end%8 == 0 {
+		byteOffset := (w - end) / 8
+		if ip.Is4() {
+			return getBits4(byteOffset, width, ip.As4())
+		}
+		return getBits16(byteOffset, width, ip.As16())
+	}
+	return bitsAt(ip, w, ss, width)
+}
+
+// bitsAt extracts the `width` bits of ip's address starting at bit offset ss (0 being the most
+// significant bit of the table's configured w-bit address, not necessarily of the real 32/128-bit
+// IP), without requiring byte alignment. w is the table's configured address width, as in
+// extractBits.
+func bitsAt(ip netaddr.IP, w, ss, width int) uint32 {
+	var b []byte
+	realBits := 32
+	if ip.Is4() {
+		a := ip.As4()
+		b = a[:]
+	} else {
+		a := ip.As16()
+		b = a[:]
+		realBits = 128
+	}
+	shift := realBits - w
+	var v uint32
+	for k := 0; k < width; k++ {
+		pos := ss + k + shift
+		var bit byte
+		if byteIdx := pos / 8; byteIdx < len(b) {
+			bit = (b[byteIdx] >> uint(7-pos%8)) & 1
+		}
+		v = (v << 1) | uint32(bit)
+	}
+	return v
+}
+
+// commonPrefixLen returns the number of leading address bits that a and b agree on, bounded by
+// the shorter of their two prefix lengths. It's used when a second route needs to descend
+// through a path-compressed slot, to find where the two routes actually diverge.
+func commonPrefixLen(a, b netaddr.IPPrefix) int {
+	max := int(a.Bits())
+	if int(b.Bits()) < max {
+		max = int(b.Bits())
+	}
+	var ab, bb []byte
+	if a.IP().Is4() {
+		a4, b4 := a.IP().As4(), b.IP().As4()
+		ab, bb = a4[:], b4[:]
+	} else {
+		a16, b16 := a.IP().As16(), b.IP().As16()
+		ab, bb = a16[:], b16[:]
+	}
+	n := 0
+	for n < max {
+		byteIdx := n / 8
+		bit := uint(7 - n%8)
+		if (ab[byteIdx]>>bit)&1 != (bb[byteIdx]>>bit)&1 {
+			break
+		}
+		n++
+	}
+	return n
 }
 
-// Table is the top level routing table interface. It stores routes to prefix match, and
+// splitStride bounds the width of a tableNode created by splitting a path-compression leaf:
+// rather than size a new node to span however many bits two colliding routes happen to share,
+// a split proceeds in splitStride-bit increments, recursing one synthetic level deeper only as
+// far as the routes actually still agree.
+const splitStride = 8
+
+// entry is the value stored behind a Table's r slots and, for a compressed leaf, a tableNode's
+// compressed field. It pairs the inserted prefix (needed to detect duplicate inserts, and to
+// test whether a looked-up IP actually falls under a compressed route) with the caller's value.
+// Two entries are considered "the same route" by comparing the *entry pointer, not their
+// contents, since allotment propagates one entry's pointer into many r slots.
+type entry[V any] struct {
+	prefix netaddr.IPPrefix
+	value  V
+}
+
+// Table is the top level routing table type. It stores routes to prefix match, and
 // longest-matching routes can be searched for by Table.Lookup. For example,
 // we can insert 127.0.0.1/4, which will match on the IP 127.255.255.255. A single Table can
 // support either IPv4 or IPv6, but not both at the same time.
-type Table struct {
+type Table[V any] struct {
 	w       int   // addr width
 	strides []int // stride lengths
-	root    *tableNode
+	root    *tableNode[V]
 }
 
 // A tableNode is an internal node in a table. It is responsible for matching on a specific
 // portion of the address, and if a more specific part of the address exists, will store some
 // number of pointers to child tableNodes. To allow for child nodes to be freed, it also
-// maintains a reference count of the number of entries in it.
-type tableNode struct {
-	// TODO: merge r and n into one slice (make a *Table that
-	// implements Route probably?), and probably remove ref.
-	r         []Route
-	n         []*tableNode // nil for single-level tables
-	ref       int          // ref counter
-	parentPtr **tableNode  // address of parent's pointer to this table
+// maintains reference counts of the number of direct route entries and children it has.
+type tableNode[V any] struct {
+	// TODO: merge r and n into one slice (make a *Table that doubles as an entry probably?),
+	// and probably remove routeRefs/childRefs.
+	r         []*entry[V]
+	n         []*tableNode[V] // nil for single-level tables, and for compressed leaves
+	routeRefs int             // number of direct route entries held in r
+	childRefs int             // number of non-nil entries in n
+	parentPtr **tableNode[V]  // address of parent's pointer to this table
+	width     int             // number of address bits this node's r/n arrays index over
+
+	// compressed, if non-nil, means this node is a path-compression leaf: rather than
+	// threading the single route beneath it through a chain of otherwise-empty
+	// intermediate tableNodes, the route is stored here directly. A compressed node has
+	// no r or n arrays; it's replaced with a real node (or several) if a second route
+	// ever needs to descend through it. See (*tableNode).insertCompressed.
+	compressed *entry[V]
 }
 
 // free deallocates a tableNode by removing the parent's pointer to it, letting it be garbage
 // collected.
-func (x *tableNode) free() {
+func (x *tableNode[V]) free() {
 	if x.parentPtr != nil {
 		*x.parentPtr = nil
 		x.parentPtr = nil
 	}
 }
 
+// soleEntry reports the single route entry held by x and everything beneath it, if x collapses
+// to exactly one route (no direct entries and more than one child, or more than one direct
+// entry, means there's nothing to report). It's used by delete to re-compress a node that a
+// deletion has reduced down to a single remaining route.
+func (x *tableNode[V]) soleEntry() *entry[V] {
+	if x.compressed != nil {
+		return x.compressed
+	}
+	switch {
+	case x.childRefs == 0 && x.routeRefs == 1:
+		for _, e := range x.r {
+			if e != nil {
+				return e
+			}
+		}
+	case x.childRefs == 1 && x.routeRefs == 0:
+		for _, c := range x.n {
+			if c != nil {
+				return c.soleEntry()
+			}
+		}
+	}
+	return nil
+}
+
 // Clone returns a deep clone of the current table.
-func (x *Table) Clone() *Table {
-	return &Table{
+func (x *Table[V]) Clone() *Table[V] {
+	return &Table[V]{
 		root: x.root.clone(),
 		// since these are immutable, they don't need to be cloned.
 		w:       x.w,
@@ -134,17 +247,20 @@ func (x *Table) Clone() *Table {
 }
 
 // clone clones an inner table node, and any child pointers.
-func (x *tableNode) clone() *tableNode {
+func (x *tableNode[V]) clone() *tableNode[V] {
 	if x == nil {
 		return nil
 	}
-	x2 := &tableNode{
-		ref:       x.ref,
-		r:         x.r,
-		parentPtr: x.parentPtr,
+	x2 := &tableNode[V]{
+		routeRefs:  x.routeRefs,
+		childRefs:  x.childRefs,
+		width:      x.width,
+		r:          x.r,
+		compressed: x.compressed,
+		parentPtr:  x.parentPtr,
 	}
 	if x.n != nil {
-		x2.n = make([]*tableNode, len(x.n))
+		x2.n = make([]*tableNode[V], len(x.n))
 		for i, v := range x.n {
 			x2.n[i] = v.clone()
 		}
@@ -152,6 +268,290 @@ func (x *tableNode) clone() *tableNode {
 	return x2
 }
 
+// copyNode returns a shallow copy of x suitable for copy-on-write mutation: it has its own r and
+// n slices, so allot and friends can mutate it without touching x, but its child tableNode
+// pointers and compressed entry are shared with x. It's the building block for
+// InsertPersistent/DeletePersistent, which copy only the nodes visited along a descent path and
+// leave the rest of the tree shared between the old and new versions.
+func (x *tableNode[V]) copyNode() *tableNode[V] {
+	x2 := &tableNode[V]{
+		routeRefs:  x.routeRefs,
+		childRefs:  x.childRefs,
+		width:      x.width,
+		compressed: x.compressed,
+	}
+	if x.r != nil {
+		x2.r = append([]*entry[V](nil), x.r...)
+	}
+	if x.n != nil {
+		x2.n = append([]*tableNode[V](nil), x.n...)
+	}
+	return x2
+}
+
+// InsertPersistent is like Insert, but instead of mutating the receiver in place, it returns a
+// new Table reflecting the insert. Only the tableNodes on the path from the root to the
+// insertion point are copied (see (*tableNode).copyNode); every other subtree is structurally
+// shared with the receiver. The receiver is left completely untouched, so readers calling Lookup
+// on it concurrently with this call (or with later InsertPersistent/DeletePersistent calls on
+// other versions of the table) need no locking.
+//
+// As with Insert, it reports whether the insertion was successful, returning the receiver
+// unchanged if a route with the same prefix already existed.
+//
+// Callers that mix this with Clone or with the mutating Insert/Delete must take care: this only
+// guarantees isolation between versions produced by the persistent API. Calling the mutating
+// Insert/Delete on a Table that's also reachable as the "before" version of an InsertPersistent
+// or DeletePersistent call will mutate nodes that version shares with its copies.
+func (x *Table[V]) InsertPersistent(prefix netaddr.IPPrefix, value V) (*Table[V], bool) {
+	root, ok := insertPersistent(x.root, x.w, &entry[V]{prefix: prefix, value: value})
+	if !ok {
+		return x, false
+	}
+	return &Table[V]{w: x.w, strides: x.strides, root: root}, true
+}
+
+// insertPersistent mirrors insert, but copies each tableNode visited along the descent path
+// (via copyNode) instead of mutating it, returning the new root.
+func insertPersistent[V any](root *tableNode[V], w int, e *entry[V]) (*tableNode[V], bool) {
+	newRoot := root.copyNode()
+	ipp := e.prefix
+	if ipp.Bits() == 0 {
+		if newRoot.r[1] != nil {
+			return nil, false
+		}
+		newRoot.r[1] = e
+		newRoot.routeRefs++
+		return newRoot, true
+	}
+
+	x := newRoot
+	ss := 0
+	for {
+		width := x.width
+		rem := int(ipp.Bits()) - ss
+		if rem <= width {
+			bits := extractBits(ipp.IP(), w, ss, width)
+			if !x.insertSingle(width, bits, rem, e) {
+				return nil, false
+			}
+			x.routeRefs++
+			return newRoot, true
+		}
+
+		bits := extractBits(ipp.IP(), w, ss, width)
+		i := fringeIndex(width, bits)
+		switch {
+		case x.n[i] == nil:
+			x.n[i] = &tableNode[V]{compressed: e}
+			x.childRefs++
+			return newRoot, true
+		case x.n[i].compressed != nil:
+			child, ok := insertCompressedPersistent(x.n[i], ss+width, w, e)
+			if !ok {
+				return nil, false
+			}
+			x.n[i] = child
+			return newRoot, true
+		}
+		child := x.n[i].copyNode()
+		x.n[i] = child
+		x = child
+		ss += width
+	}
+}
+
+// insertCompressedPersistent mirrors (*tableNode).insertCompressed, but returns the new subtree
+// to install in place of the split leaf, rather than splicing itself in via parentPtr. It has no
+// existing nodes to preserve (a compressed leaf has no r or n arrays), so there's nothing to
+// copy-on-write here beyond building the new split node(s) fresh, exactly as insertCompressed
+// does.
+func insertCompressedPersistent[V any](leaf *tableNode[V], ss, w int, e *entry[V]) (*tableNode[V], bool) {
+	old := leaf.compressed
+	if old.prefix == e.prefix {
+		return nil, false
+	}
+
+	common := commonPrefixLen(old.prefix, e.prefix)
+	oldRem := int(old.prefix.Bits()) - ss
+	newRem := int(e.prefix.Bits()) - ss
+	relCommon := common - ss
+
+	width := relCommon + 1
+	switch relCommon {
+	case oldRem:
+		width = oldRem
+	case newRem:
+		width = newRem
+	}
+	if width > splitStride {
+		width = splitStride
+	}
+
+	child := newTableNode[V](width)
+
+	oldBits := bitsAt(old.prefix.IP(), w, ss, width)
+	if oldRem <= width {
+		child.insertSingle(width, oldBits, oldRem, old)
+		child.routeRefs++
+	} else {
+		oi := fringeIndex(width, oldBits)
+		child.n[oi] = &tableNode[V]{compressed: old}
+		child.childRefs++
+	}
+
+	newBits := bitsAt(e.prefix.IP(), w, ss, width)
+	if newRem <= width {
+		if child.insertSingle(width, newBits, newRem, e) {
+			child.routeRefs++
+		}
+		return child, true
+	}
+	ni := fringeIndex(width, newBits)
+	if child.n[ni] == nil {
+		child.n[ni] = &tableNode[V]{compressed: e}
+		child.childRefs++
+		return child, true
+	}
+
+	grandchild, ok := insertCompressedPersistent(child.n[ni], ss+width, w, e)
+	if !ok {
+		return nil, false
+	}
+	child.n[ni] = grandchild
+	return child, true
+}
+
+// DeletePersistent is like Delete, but instead of mutating the receiver in place, it returns a
+// new Table reflecting the deletion. As with InsertPersistent, only the tableNodes on the path
+// to the deleted route are copied, and the receiver is left untouched for concurrent readers.
+func (x *Table[V]) DeletePersistent(prefix netaddr.IPPrefix) (*Table[V], V, bool) {
+	root, e, ok := deletePersistent(x.root, x.w, prefix)
+	if !ok {
+		var zero V
+		return x, zero, false
+	}
+	return &Table[V]{w: x.w, strides: x.strides, root: root}, e.value, true
+}
+
+// deletePersistent mirrors delete, but copies each tableNode visited along the descent path
+// instead of mutating it in place, returning the new root. Unlike delete, which splices
+// recompressed or freed nodes into the tree in place via unwind, it builds the replacement for
+// each visited node bottom-up (see collapse and deleteFromNode) and returns it to the caller to
+// install in its own copy.
+func deletePersistent[V any](root *tableNode[V], w int, ipp netaddr.IPPrefix) (*tableNode[V], *entry[V], bool) {
+	root2 := root.copyNode()
+
+	if ipp.Bits() == 0 {
+		e := root2.r[1]
+		if e == nil {
+			return nil, nil, false
+		}
+		root2.r[1] = nil
+		root2.routeRefs--
+		return root2, e, true
+	}
+
+	width := root2.width
+	rem := int(ipp.Bits())
+	if rem <= width {
+		bits := extractBits(ipp.IP(), w, 0, width)
+		e, ok := root2.deleteSingle(width, bits, rem)
+		if !ok {
+			return nil, nil, false
+		}
+		root2.routeRefs--
+		return root2, e, true
+	}
+
+	bits := extractBits(ipp.IP(), w, 0, width)
+	i := fringeIndex(width, bits)
+	child := root2.n[i]
+	if child == nil {
+		return nil, nil, false
+	}
+	newChild, e, ok := deleteFromNode(child, w, width, ipp)
+	if !ok {
+		return nil, nil, false
+	}
+	root2.n[i] = newChild
+	if newChild == nil {
+		root2.childRefs--
+	}
+	return root2, e, true
+}
+
+// deleteFromNode deletes ipp from the subtree rooted at x (reached after consuming ss address
+// bits to get here), returning the replacement for x's slot in its parent: nil if x is now
+// completely empty, a fresh compressed leaf if x has collapsed down to exactly one remaining
+// route, or a copy of x otherwise. See collapse.
+func deleteFromNode[V any](x *tableNode[V], w, ss int, ipp netaddr.IPPrefix) (*tableNode[V], *entry[V], bool) {
+	if x.compressed != nil {
+		if x.compressed.prefix != ipp {
+			return nil, nil, false
+		}
+		return nil, x.compressed, true
+	}
+
+	x2 := x.copyNode()
+	width := x2.width
+	rem := int(ipp.Bits()) - ss
+	if rem <= width {
+		bits := extractBits(ipp.IP(), w, ss, width)
+		e, ok := x2.deleteSingle(width, bits, rem)
+		if !ok {
+			return nil, nil, false
+		}
+		x2.routeRefs--
+		return collapse(x2), e, true
+	}
+
+	bits := extractBits(ipp.IP(), w, ss, width)
+	i := fringeIndex(width, bits)
+	child := x2.n[i]
+	if child == nil {
+		return nil, nil, false
+	}
+	newChild, e, ok := deleteFromNode(child, w, ss+width, ipp)
+	if !ok {
+		return nil, nil, false
+	}
+	x2.n[i] = newChild
+	if newChild == nil {
+		x2.childRefs--
+	}
+	return collapse(x2), e, true
+}
+
+// collapse is the copy-on-write analog of unwind's per-node check: it reports what to actually
+// store in place of x2, which has just had a route or child removed from it: nil if x2 is now
+// completely empty, a fresh compressed leaf if x2 has collapsed down to exactly one remaining
+// route (see (*tableNode).soleEntry), or x2 itself otherwise.
+func collapse[V any](x2 *tableNode[V]) *tableNode[V] {
+	if x2.routeRefs == 0 && x2.childRefs == 0 {
+		return nil
+	}
+	if e := x2.soleEntry(); e != nil {
+		return &tableNode[V]{compressed: e}
+	}
+	return x2
+}
+
+// Snapshot returns an immutable handle to the table's current contents, safe to hand to
+// concurrent readers: since InsertPersistent and DeletePersistent never mutate existing
+// tableNodes (they only ever build copies), a snapshot's Lookup calls require no
+// synchronization with later InsertPersistent/DeletePersistent calls that produce other
+// versions of the table, and never observe them.
+//
+// Snapshot itself is O(1) and shares the entire tree with the receiver; it exists mostly as
+// documentation of intent at the handoff point. From here on, keep using the persistent API
+// (InsertPersistent/DeletePersistent) to derive further versions — mutating this Table (or the
+// one it was taken from) with Insert/Delete after this point is not safe for a reader holding
+// this snapshot.
+func (x *Table[V]) Snapshot() *Table[V] {
+	return x
+}
+
 // NewTable creates a new table with the given number of strides that determines the granularity
 // of allocations. Strides represents the length of each prefix matching level, so having
 // smaller strides implies many tiny allocations, larger implies few but large allocations. Each
@@ -161,7 +561,12 @@ func (x *tableNode) clone() *tableNode {
 //
 // A good default for strides for IPv4 is 16,8,8, but experimentation on your specific dataset
 // may lead to better configurations.
-func NewTable(strides []int) *Table {
+//
+// Only the first stride actually determines any allocation: path compression (see
+// (*tableNode).insertCompressed) means deeper levels are sized on demand from the routes
+// actually inserted, rather than preallocated to strides[1:]'s widths. The rest of strides is
+// still validated, since it documents the intended granularity and determines w.
+func NewTable[V any](strides []int) *Table[V] {
 	w := 0
 	for i, s := range strides {
 		if s%8 != 0 && i != len(strides)-1 {
@@ -176,27 +581,28 @@ func NewTable(strides []int) *Table {
 		panic("Number of strides larger than max number of levels supported")
 	}
 
-	return &Table{
+	return &Table[V]{
 		w:       w,
 		strides: strides,
 
 		// create an empty root level table, with the size of strides 0.
-		root: newTableNode(strides[0]),
+		root: newTableNode[V](strides[0]),
 	}
 }
 
-func newTableNode(stride int) *tableNode {
+func newTableNode[V any](stride int) *tableNode[V] {
 	n := 1 << (stride + 1)
-	return &tableNode{
-		r: make([]Route, n),
-		n: make([]*tableNode, n),
+	return &tableNode[V]{
+		r:     make([]*entry[V], n),
+		n:     make([]*tableNode[V], n),
+		width: stride,
 	}
 }
 
-// allot allots route r replacing q at base index b.
-func (x *tableNode) allot(smallestFringeIndex, b uint32, q, r Route) {
+// allot allots entry r replacing q at base index b.
+func (x *tableNode[V]) allot(smallestFringeIndex, b uint32, q, r *entry[V]) {
 	t := smallestFringeIndex
-	if (x.r[b] == nil && q == nil) || x.r[b].Equals(q) {
+	if x.r[b] == q {
 		x.r[b] = r
 	} else {
 		return
@@ -211,139 +617,190 @@ func (x *tableNode) allot(smallestFringeIndex, b uint32, q, r Route) {
 	x.allot(t, b, q, r) // allot r to right children
 }
 
-// insertSingle inserts a given route into the table, with the given prefix len remaining and
-// width (which is the stride at a given level).  addr is not the full address, but a subset of
-// bits contained in the IP. r contains the entire IP and any additional metadata which can be
-// retrieved later.
-func (x *tableNode) insertSingle(w int, addr uint32, prefix int, r Route) bool {
+// insertSingle inserts a given entry into the table, with the given prefix len remaining and
+// width (which is this node's own width). addr is not the full address, but the width bits of
+// it that fall within this node. e contains the prefix and value to insert.
+func (x *tableNode[V]) insertSingle(w int, addr uint32, prefix int, e *entry[V]) bool {
 	b := baseIndex(w, addr, prefix)
 	xb := x.r[b]
 	if xb != nil {
-		if r.IPPrefix() == xb.IPPrefix() {
+		if e.prefix == xb.prefix {
 			// previously, this route was already inserted, need to delete it explicitly.
 			return false
 		}
 	}
-	x.allot(1<<w, b, xb, r)
+	x.allot(1<<w, b, xb, e)
 	return true
 }
 
-// Insert will add the given route using its IPPrefix into the table, allocating if necessary.
+// insertCompressed splits the path-compression leaf at x.n[i] to make room for a second,
+// diverging route e. ss is the number of address bits already consumed on the way to x.n[i]
+// (i.e. including x's own width). w is the table's configured address width, as in extractBits.
+//
+// Splitting proceeds in splitStride-bit increments (see splitStride): at each step it builds one
+// new intermediate tableNode sized to either reach the point the two routes diverge, or to
+// exactly absorb whichever of the two routes terminates first, whichever comes first. When the
+// two routes still agree on every bit of a splitStride-capped window, the loop recurses one
+// synthetic level deeper rather than growing the node to span the whole common run.
+func (x *tableNode[V]) insertCompressed(i uint32, ss, w int, e *entry[V]) bool {
+	for {
+		old := x.n[i].compressed
+		if old.prefix == e.prefix {
+			return false
+		}
+
+		common := commonPrefixLen(old.prefix, e.prefix)
+		oldRem := int(old.prefix.Bits()) - ss
+		newRem := int(e.prefix.Bits()) - ss
+		relCommon := common - ss
+
+		width := relCommon + 1
+		switch relCommon {
+		case oldRem:
+			width = oldRem
+		case newRem:
+			width = newRem
+		}
+		if width > splitStride {
+			width = splitStride
+		}
+
+		child := newTableNode[V](width)
+		child.parentPtr = x.n[i].parentPtr
+		*child.parentPtr = child
+
+		oldBits := bitsAt(old.prefix.IP(), w, ss, width)
+		if oldRem <= width {
+			child.insertSingle(width, oldBits, oldRem, old)
+			child.routeRefs++
+		} else {
+			oi := fringeIndex(width, oldBits)
+			child.n[oi] = &tableNode[V]{compressed: old, parentPtr: &child.n[oi]}
+			child.childRefs++
+		}
+
+		newBits := bitsAt(e.prefix.IP(), w, ss, width)
+		if newRem <= width {
+			if child.insertSingle(width, newBits, newRem, e) {
+				child.routeRefs++
+			}
+			return true
+		}
+		ni := fringeIndex(width, newBits)
+		if child.n[ni] == nil {
+			child.n[ni] = &tableNode[V]{compressed: e, parentPtr: &child.n[ni]}
+			child.childRefs++
+			return true
+		}
+
+		// Both routes still agree on every bit within this (splitStride-capped) node;
+		// recurse one synthetic level deeper to find where they actually diverge.
+		x, i, ss = child, ni, ss+width
+	}
+}
+
+// Insert will add the given value under prefix into the table, allocating if necessary.
 // Returns true if it was inserted, otherwise returns false if there already exists an item with
-// the same IPPrefix.
-func (x *Table) Insert(r Route) bool {
-	return insert(x.root, x.w, x.strides, r)
+// the same prefix.
+func (x *Table[V]) Insert(prefix netaddr.IPPrefix, value V) bool {
+	return insert(x.root, x.w, &entry[V]{prefix: prefix, value: value})
 }
 
-// insert is multi-level insertion ("Algorithm 5).
+// insert is multi-level insertion ("Algorithm 5), extended with path compression: a route that
+// would otherwise require descending through a chain of empty intermediate tableNodes is
+// instead stored directly as a compressed leaf, and only split back into real nodes once a
+// second route needs to diverge from it (see (*tableNode).insertCompressed).
 //
-// sl: stride length by level
+// w: total address width (32 or 128)
 //
 // It reports whether the insertion was successful.
-func insert(x0 *tableNode, w int, sl []int, r Route) bool {
-	x := x0 // "Array X <- X0", level 0 array
-
-	ipp := r.IPPrefix()
+func insert[V any](root *tableNode[V], w int, e *entry[V]) bool {
+	ipp := e.prefix
 	if ipp.Bits() == 0 {
-		if x.r[1] != nil {
+		if root.r[1] != nil {
 			return false // already had a default route
 		}
-		x.r[1] = r // default route
+		root.r[1] = e // default route
+		root.routeRefs++
 		return true
 	}
-	// getBits will get some number of bits in either ipv4 or ipv6.
-	var getBits func(ss, sl int) uint32
-	if ipp.IP().Is4() {
-		ipv4 := ipp.IP().As4()
-		getBits = func(ss, sl int) uint32 {
-			return getBits4((w-ss)/8, sl, ipv4)
-		}
-	} else {
-		ipv6 := ipp.IP().As16()
-		getBits = func(ss, sl int) uint32 {
-			return getBits16((w-ss)/8, sl, ipv6)
-		}
-	}
 
-	var s uint32 // stride
-	level := 0
-	ss := 0 // stride length summation
+	x := root
+	ss := 0
 	for {
-		ss += sl[level]
-
-		// stride:
-		s = getBits(ss, sl[level])
-		if int(ipp.Bits()) <= ss {
-			break
+		width := x.width
+		rem := int(ipp.Bits()) - ss
+		if rem <= width {
+			bits := extractBits(ipp.IP(), w, ss, width)
+			if x.insertSingle(width, bits, rem, e) {
+				x.routeRefs++
+				return true
+			}
+			return false
 		}
-		i := fringeIndex(sl[level], s)
-		// If the next level is unoccupied, allocate it and increase refs
-		if x.n[i] == nil {
-			child := newTableNode(sl[level+1])
-			x.n[i] = child
-			child.parentPtr = &x.n[i]
-			x.ref++
+
+		bits := extractBits(ipp.IP(), w, ss, width)
+		i := fringeIndex(width, bits)
+		switch {
+		case x.n[i] == nil:
+			// Path compression: rather than eagerly building a chain of otherwise-empty
+			// intermediate nodes, store the remaining route directly.
+			x.n[i] = &tableNode[V]{compressed: e, parentPtr: &x.n[i]}
+			x.childRefs++
+			return true
+		case x.n[i].compressed != nil:
+			return x.insertCompressed(i, ss+width, w, e)
 		}
 		x = x.n[i]
-		level++
+		ss += width
 	}
-
-	ss -= sl[level]
-	if x.insertSingle(sl[level], s, int(ipp.Bits())-ss, r) {
-		x.ref++ // new route entry
-		return true
-	}
-	return false
 }
 
 // lookupSingle looks up an addr in a tableNode, treating it as a leaf node with no children.
-func (x *tableNode) lookupSingle(width int, addr uint32) (r Route, ok bool) {
-	r = x.r[fringeIndex(width, addr)]
-	return r, r != nil
+func (x *tableNode[V]) lookupSingle(width int, addr uint32) (e *entry[V], ok bool) {
+	e = x.r[fringeIndex(width, addr)]
+	return e, e != nil
 }
 
-// Lookup looks up the most specific Route for the given addr. Returns found, true if there
-// exists a route, otherwise nil, false.
-func (x *Table) Lookup(ip netaddr.IP) (found Route, ok bool) {
-	found = searchMultiLevel(x.root, x.w, x.strides, ip)
-	return found, found != nil
+// Lookup looks up the most specific value for the given addr. Returns the value and true if
+// there exists a route, otherwise the zero value and false.
+func (x *Table[V]) Lookup(ip netaddr.IP) (value V, ok bool) {
+	found := searchMultiLevel(x.root, x.w, ip)
+	if found == nil {
+		return value, false
+	}
+	return found.value, true
 }
 
-// Algorithm 7
+// Algorithm 7, extended to handle path-compressed leaves: once a search reaches one, the
+// remaining lookup is a single prefix containment check rather than a further descent.
 //
-// Returns longest prefix matching route pointer or nil
-func searchMultiLevel(x0 *tableNode, w int, sl []int, ip netaddr.IP) (found Route) {
-	lmr := x0.r[1] // longest matching route
-	x := x0
-
-	// getBits will get some number of bits in either ipv4 or ipv6.
-	var getBits func(ss, sl int) uint32
-	if ip.Is4() {
-		ipv4 := ip.As4()
-		getBits = func(ss, sl int) uint32 {
-			return getBits4((w-ss)/8, sl, ipv4)
-		}
-	} else {
-		ipv6 := ip.As16()
-		getBits = func(ss, sl int) uint32 {
-			return getBits16((w-ss)/8, sl, ipv6)
-		}
-	}
-
-	level := 0
+// Returns longest prefix matching entry or nil
+func searchMultiLevel[V any](root *tableNode[V], w int, ip netaddr.IP) (found *entry[V]) {
+	lmr := root.r[1] // longest matching route
+	x := root
 	ss := 0
 	for {
-		s := sl[level]
-		ss += s
-		// stride:
-		i := fringeIndex(s, getBits(ss, s))
-		if x.n[i] != nil {
+		width := x.width
+		bits := extractBits(ip, w, ss, width)
+		i := fringeIndex(width, bits)
+		child := x.n[i]
+		switch {
+		case child != nil && child.compressed != nil:
+			if x.r[i] != nil {
+				lmr = x.r[i]
+			}
+			if child.compressed.prefix.Contains(ip) {
+				return child.compressed
+			}
+			return lmr
+		case child != nil:
 			// update current longest matching route
 			if x.r[i] != nil {
 				lmr = x.r[i]
 			}
-			x = x.n[i]
-		} else {
+			x = child
+		default:
 			if x.r[i] != nil {
 				return x.r[i]
 			}
@@ -351,13 +808,13 @@ func searchMultiLevel(x0 *tableNode, w int, sl []int, ip netaddr.IP) (found Rout
 			// this will return nil.
 			return lmr
 		}
-		level++
+		ss += width
 	}
 }
 
 // deleteSingle removes a subset of an address with a given prefix and width from a
-// single-level table, returning the old item if it existed
-func (x *tableNode) deleteSingle(w int, addr uint32, prefix int) (deleted Route, ok bool) {
+// single-level table, returning the old entry if it existed
+func (x *tableNode[V]) deleteSingle(w int, addr uint32, prefix int) (deleted *entry[V], ok bool) {
 	b := baseIndex(w, addr, prefix)
 	prev := x.r[b]
 	if prev == nil {
@@ -372,82 +829,459 @@ func (x *tableNode) deleteSingle(w int, addr uint32, prefix int) (deleted Route,
 // that a stride is smaller than a byte on IPv6.
 const maxLevel = 16
 
-// Delete deletes the route described by the parameters.
-// If a route was deleted, it returns the deleted route, and true,
-// otherwise it returns nil and false.
-func (x *Table) Delete(ipp netaddr.IPPrefix) (deleted Route, ok bool) {
-	return delete(x.root, x.w, x.strides, ipp)
+// unwind walks back up from x (at the given level, with xsv holding each level's parent node)
+// after a route or child has just been removed from x, freeing nodes that are now completely
+// empty and re-compressing nodes that have collapsed down to a single remaining route. It stops
+// as soon as it hits a node that's neither, since that node's makeup (and so every ancestor
+// above it) is then unchanged.
+//
+// Recompressing a node doesn't change its parent's ref counts (the parent's child slot is still
+// occupied, just by a leaf instead of a real node), but it can still make the parent itself newly
+// collapsible, since soleEntry looks through single children to find the one remaining route. So
+// unlike freeing, recompressing still requires continuing the walk upward.
+func unwind[V any](x *tableNode[V], level int, xsv [maxLevel]*tableNode[V]) {
+	for level > 0 {
+		if x.routeRefs == 0 && x.childRefs == 0 {
+			x.free()
+			level--
+			x = xsv[level]
+			x.childRefs--
+			continue
+		}
+		e := x.soleEntry()
+		if e == nil {
+			return
+		}
+		*x.parentPtr = &tableNode[V]{compressed: e, parentPtr: x.parentPtr}
+		level--
+		x = xsv[level]
+	}
+}
+
+// Delete deletes the route described by prefix.
+// If a route was deleted, it returns the deleted value, and true,
+// otherwise it returns the zero value and false.
+func (x *Table[V]) Delete(prefix netaddr.IPPrefix) (deleted V, ok bool) {
+	e, ok := delete(x.root, x.w, prefix)
+	if !ok {
+		return deleted, false
+	}
+	return e.value, true
 }
 
-// delete is multi-level deletion (Algorithm 6)
+// delete is multi-level deletion (Algorithm 6), extended to unwind path-compressed and
+// split nodes (see unwind) as routes are removed from them.
 //
-// w: address length
-// sl: stride length by level
-// a: destination address
-// pl: prefix length
+// w: total address width (32 or 128)
 //
-// It returns the deleted route and whether it was successful.
-func delete(x0 *tableNode, w int, sl []int, ipp netaddr.IPPrefix) (r Route, ok bool) {
-	x := x0
-	xsv := [maxLevel]*tableNode{0: x} // parent array pointers
-	var isv [maxLevel]uint32          // parent indices
-
+// It returns the deleted entry and whether it was successful.
+func delete[V any](root *tableNode[V], w int, ipp netaddr.IPPrefix) (e *entry[V], ok bool) {
 	// Default route.
 	if ipp.Bits() == 0 {
-		if r = x.r[1]; r == nil {
+		if e = root.r[1]; e == nil {
 			return nil, false
 		}
-		x.r[1] = nil
-		return r, true
-	}
-	// getBits will get some number of bits in either ipv4 or ipv6.
-	var getBits func(ss, sl int) uint32
-	if ipp.IP().Is4() {
-		ipv4 := ipp.IP().As4()
-		getBits = func(ss, sl int) uint32 {
-			return getBits4((w-ss)/8, sl, ipv4)
-		}
-	} else {
-		ipv6 := ipp.IP().As16()
-		getBits = func(ss, sl int) uint32 {
-			return getBits16((w-ss)/8, sl, ipv6)
-		}
+		root.r[1] = nil
+		root.routeRefs--
+		return e, true
 	}
 
-	ss := 0      // stride length summation
-	var s uint32 // stride
+	x := root
+	xsv := [maxLevel]*tableNode[V]{0: x} // parent array pointers
+	ss := 0
 	level := 0
 	for {
-		ss += sl[level]
-		s = getBits(ss, sl[level])
-		if int(ipp.Bits()) <= ss {
-			break
+		width := x.width
+		rem := int(ipp.Bits()) - ss
+		if rem <= width {
+			bits := extractBits(ipp.IP(), w, ss, width)
+			e, ok = x.deleteSingle(width, bits, rem)
+			if !ok {
+				return nil, false
+			}
+			x.routeRefs--
+			unwind(x, level, xsv)
+			return e, true
 		}
-		i := fringeIndex(sl[level], s)
-		isv[level] = i
-		if x.n[i] == nil {
+
+		bits := extractBits(ipp.IP(), w, ss, width)
+		i := fringeIndex(width, bits)
+		child := x.n[i]
+		if child == nil {
+			return nil, false
+		}
+		if child.compressed != nil {
+			if child.compressed.prefix != ipp {
+				return nil, false
+			}
+			e = child.compressed
+			child.free()
+			x.childRefs--
+			unwind(x, level, xsv)
+			return e, true
+		}
+		if level+1 >= maxLevel {
+			// Splits proceed in small, bounded steps (see splitStride) so this
+			// shouldn't happen in practice, but don't run past the parent stack.
 			return nil, false
 		}
 		xsv[level] = x
-		x = x.n[i]
+		x = child
 		level++
+		ss += width
+	}
+}
+
+// Walk calls yield once for every distinct route inserted into the table, in no particular
+// order, stopping early if yield returns false. Because the allotment scheme replicates each
+// inserted route across every r slot it covers, Walk has to distinguish a slot a route was
+// actually inserted at from one it was merely propagated down to: it does so the same way
+// insertSingle detects a collision, by comparing a slot against its own parent slot (b>>1) and
+// skipping it if they hold the same *entry.
+func (x *Table[V]) Walk(yield func(prefix netaddr.IPPrefix, value V) bool) {
+	walk(x.root, yield)
+}
+
+// walk is Walk's recursive implementation, also reused by Subnets once it's located the
+// subtree to enumerate.
+func walk[V any](x *tableNode[V], yield func(netaddr.IPPrefix, V) bool) bool {
+	if x == nil {
+		return true
+	}
+	if x.compressed != nil {
+		e := x.compressed
+		return yield(e.prefix, e.value)
+	}
+	for b, e := range x.r {
+		if e == nil {
+			continue
+		}
+		if b >= 2 && x.r[b>>1] == e {
+			continue // propagated down from a covering route, not inserted here
+		}
+		if !yield(e.prefix, e.value) {
+			return false
+		}
+	}
+	for _, c := range x.n {
+		if !walk(c, yield) {
+			return false
+		}
+	}
+	return true
+}
+
+// Supernets returns an iterator, from least to most specific, over every route inserted into
+// the table that contains prefix (including prefix itself, if it was inserted).
+func (x *Table[V]) Supernets(prefix netaddr.IPPrefix) iter.Seq2[netaddr.IPPrefix, V] {
+	return func(yield func(netaddr.IPPrefix, V) bool) {
+		supernets(x.root, x.w, prefix, yield)
+	}
+}
+
+// supernets walks from the root toward prefix's own node, yielding every r slot along the way
+// that was actually inserted at (rather than propagated to; see walk) at each address length up
+// to prefix's own. Every such slot is, by construction, a route whose prefix contains prefix.
+func supernets[V any](n *tableNode[V], w int, prefix netaddr.IPPrefix, yield func(netaddr.IPPrefix, V) bool) bool {
+	bits := int(prefix.Bits())
+	ss := 0
+	for {
+		if n.compressed != nil {
+			e := n.compressed
+			if int(e.prefix.Bits()) <= bits && e.prefix.Contains(prefix.IP()) {
+				return yield(e.prefix, e.value)
+			}
+			return true
+		}
+
+		width := n.width
+		rem := bits - ss
+		lim := width
+		if rem < lim {
+			lim = rem
+		}
+		addr := extractBits(prefix.IP(), w, ss, width)
+		for l := 0; l <= lim; l++ {
+			b := baseIndex(width, addr, l)
+			e := n.r[b]
+			if e == nil || (b >= 2 && n.r[b>>1] == e) {
+				continue
+			}
+			if !yield(e.prefix, e.value) {
+				return false
+			}
+		}
+
+		if rem <= width {
+			return true
+		}
+		child := n.n[fringeIndex(width, addr)]
+		if child == nil {
+			return true
+		}
+		n = child
+		ss += width
+	}
+}
+
+// Subnets returns an iterator over every route inserted into the table that's contained within
+// prefix (including prefix itself, if it was inserted), in no particular order.
+func (x *Table[V]) Subnets(prefix netaddr.IPPrefix) iter.Seq2[netaddr.IPPrefix, V] {
+	return func(yield func(netaddr.IPPrefix, V) bool) {
+		subnets(x.root, x.w, prefix, yield)
+	}
+}
+
+// subnets descends to the node covering prefix exactly as insert/searchMultiLevel would, then
+// enumerates just that node's base-index subtree (see walkBaseIndex), which holds precisely the
+// routes contained within prefix.
+func subnets[V any](n *tableNode[V], w int, prefix netaddr.IPPrefix, yield func(netaddr.IPPrefix, V) bool) bool {
+	bits := int(prefix.Bits())
+	ss := 0
+	for {
+		if n.compressed != nil {
+			e := n.compressed
+			if prefix.Contains(e.prefix.IP()) && int(e.prefix.Bits()) >= bits {
+				return yield(e.prefix, e.value)
+			}
+			return true
+		}
+
+		width := n.width
+		rem := bits - ss
+		addr := extractBits(prefix.IP(), w, ss, width)
+		if rem <= width {
+			return walkBaseIndex(n, baseIndex(width, addr, rem), yield)
+		}
+		child := n.n[fringeIndex(width, addr)]
+		if child == nil {
+			return true
+		}
+		n = child
+		ss += width
+	}
+}
+
+// walkBaseIndex yields every genuinely-inserted route (see walk) in n's base-index subtree
+// rooted at b: b itself, everything nested under it within n's own r array, and, once b reaches
+// a fringe index, the full subtree of the child it corresponds to.
+func walkBaseIndex[V any](n *tableNode[V], b uint32, yield func(netaddr.IPPrefix, V) bool) bool {
+	width := uint32(n.width)
+	if e := n.r[b]; e != nil && (b < 2 || n.r[b>>1] != e) {
+		if !yield(e.prefix, e.value) {
+			return false
+		}
+	}
+	if b < 1<<width {
+		return walkBaseIndex(n, b<<1, yield) && walkBaseIndex(n, b<<1|1, yield)
 	}
+	return walk(n.n[b], yield)
+}
 
-	ss -= sl[level]
-	r, ok = x.deleteSingle(sl[level], s, int(ipp.Bits())-ss)
+// getExact reports the value inserted under exactly ipp (unlike Lookup, which reports the
+// longest matching route for an address), and whether ipp has a route at all.
+func getExact[V any](root *tableNode[V], w int, ipp netaddr.IPPrefix) (v V, ok bool) {
+	if ipp.Bits() == 0 {
+		if e := root.r[1]; e != nil {
+			return e.value, true
+		}
+		return v, false
+	}
+	return exactInSubtree(root, w, 0, ipp)
+}
+
+// exactInSubtree is getExact's descent loop, split out so it can be started from any node
+// already ss bits into ipp's address (as pairedWalk does), rather than always from a table's
+// root.
+func exactInSubtree[V any](x *tableNode[V], w, ss int, ipp netaddr.IPPrefix) (v V, ok bool) {
+	for {
+		if x.compressed != nil {
+			if x.compressed.prefix == ipp {
+				return x.compressed.value, true
+			}
+			return v, false
+		}
+
+		width := x.width
+		rem := int(ipp.Bits()) - ss
+		bits := extractBits(ipp.IP(), w, ss, width)
+		if rem <= width {
+			if e := x.r[baseIndex(width, bits, rem)]; e != nil && e.prefix == ipp {
+				return e.value, true
+			}
+			return v, false
+		}
+
+		child := x.n[fringeIndex(width, bits)]
+		if child == nil {
+			return v, false
+		}
+		x = child
+		ss += width
+	}
+}
+
+// stridesEqual reports whether a and b describe the same stride configuration.
+func stridesEqual(a, b []int) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i, s := range a {
+		if b[i] != s {
+			return false
+		}
+	}
+	return true
+}
+
+// pairedWalk is the shared traversal behind Union, Intersect, and Diff. a and b must have been
+// built with identical strides, so for as long as their shapes agree (every level neither side
+// has path-compressed or split differently) it descends them together and compares their r and
+// n slots directly, rather than walking one side and independently re-descending into the
+// other from its own root to look each prefix up (as getExact does). It calls yield once for
+// every address where either side holds a genuinely-inserted route (see walk), passing that
+// side's entry, or nil if the other side has nothing there.
+func pairedWalk[V any](a, b *tableNode[V], w, ss int, yield func(ae, be *entry[V]) bool) bool {
+	switch {
+	case a == nil && b == nil:
+		return true
+	case a == nil:
+		return walk(b, func(prefix netaddr.IPPrefix, value V) bool {
+			return yield(nil, &entry[V]{prefix: prefix, value: value})
+		})
+	case b == nil:
+		return walk(a, func(prefix netaddr.IPPrefix, value V) bool {
+			return yield(&entry[V]{prefix: prefix, value: value}, nil)
+		})
+	}
+
+	if a.compressed != nil || b.compressed != nil || a.width != b.width {
+		return pairedWalkFallback(a, b, w, ss, yield)
+	}
+
+	for i := range a.r {
+		aOwn := a.r[i] != nil && (i < 2 || a.r[i>>1] != a.r[i])
+		bOwn := b.r[i] != nil && (i < 2 || b.r[i>>1] != b.r[i])
+		switch {
+		case aOwn && bOwn:
+			if !yield(a.r[i], b.r[i]) {
+				return false
+			}
+		case aOwn:
+			if !yield(a.r[i], nil) {
+				return false
+			}
+		case bOwn:
+			if !yield(nil, b.r[i]) {
+				return false
+			}
+		}
+	}
+
+	width := a.width
+	for i := range a.n {
+		if !pairedWalk(a.n[i], b.n[i], w, ss+width, yield) {
+			return false
+		}
+	}
+	return true
+}
+
+// pairedWalkFallback handles the cases pairedWalk can't compare slot-by-slot: a compressed leaf
+// on either side, or real nodes whose widths have diverged because path compression split them
+// differently on each side. It walks a, looking each of a's routes up directly in b's subtree
+// (see exactInSubtree, which descends only from b rather than from b's table's root), then
+// walks b for whatever a didn't already account for.
+func pairedWalkFallback[V any](a, b *tableNode[V], w, ss int, yield func(ae, be *entry[V]) bool) bool {
+	matched := map[netaddr.IPPrefix]bool{}
+	ok := walk(a, func(prefix netaddr.IPPrefix, value V) bool {
+		ae := &entry[V]{prefix: prefix, value: value}
+		if bv, found := exactInSubtree(b, w, ss, prefix); found {
+			matched[prefix] = true
+			return yield(ae, &entry[V]{prefix: prefix, value: bv})
+		}
+		return yield(ae, nil)
+	})
 	if !ok {
-		return nil, false
+		return false
 	}
+	return walk(b, func(prefix netaddr.IPPrefix, value V) bool {
+		if matched[prefix] {
+			return true
+		}
+		return yield(nil, &entry[V]{prefix: prefix, value: value})
+	})
+}
 
-	// Free arrays if necessary, looking for 0 items with 0 references, and cleaning up pointers.
-	x.ref--
-	for level > 0 && x.ref == 0 {
-		x.free()
-		level--        // get parent level
-		x = xsv[level] // get parent array pointer
-		// child array is deleted, decrement reference
-		x.ref--
+// Union returns a new Table holding the combined routes of x and y, which must have been
+// created with identical strides. Where x and y both have a route for the same prefix, resolve
+// picks which of the two values the result keeps.
+func (x *Table[V]) Union(y *Table[V], resolve func(a, b V) V) *Table[V] {
+	if !stridesEqual(x.strides, y.strides) {
+		panic("art: Union requires tables with identical strides")
 	}
+	out := NewTable[V](x.strides)
+	pairedWalk(x.root, y.root, x.w, 0, func(ae, be *entry[V]) bool {
+		switch {
+		case ae != nil && be != nil:
+			out.Insert(ae.prefix, resolve(ae.value, be.value))
+		case ae != nil:
+			out.Insert(ae.prefix, ae.value)
+		default:
+			out.Insert(be.prefix, be.value)
+		}
+		return true
+	})
+	return out
+}
 
-	return r, true
+// Intersect returns a new Table holding only the prefixes present in both x and y (with x's
+// value), which must have been created with identical strides.
+func (x *Table[V]) Intersect(y *Table[V]) *Table[V] {
+	if !stridesEqual(x.strides, y.strides) {
+		panic("art: Intersect requires tables with identical strides")
+	}
+	out := NewTable[V](x.strides)
+	pairedWalk(x.root, y.root, x.w, 0, func(ae, be *entry[V]) bool {
+		if ae != nil && be != nil {
+			out.Insert(ae.prefix, ae.value)
+		}
+		return true
+	})
+	return out
+}
+
+// Change describes one prefix's difference between the two tables passed to Diff: Old is the
+// receiver's value for the prefix, New is the argument's.
+type Change[V any] struct {
+	Prefix netaddr.IPPrefix
+	Old    V
+	New    V
+}
+
+// Diff compares the receiver against desired (which must have been created with identical
+// strides), reporting the prefixes that would need to be added, removed, or have their value
+// changed to reconcile the receiver into desired's state — the three-way split a caller pushing
+// routes into a kernel routing table or firewall needs to drive an incremental update, rather
+// than reprogramming every route on every change. equal reports whether two values should be
+// considered the same; a prefix present in both tables with equal values is left out of all
+// three results.
+func (x *Table[V]) Diff(desired *Table[V], equal func(a, b V) bool) (added, removed []netaddr.IPPrefix, changed []Change[V]) {
+	if !stridesEqual(x.strides, desired.strides) {
+		panic("art: Diff requires tables with identical strides")
+	}
+	pairedWalk(x.root, desired.root, x.w, 0, func(ae, be *entry[V]) bool {
+		switch {
+		case ae != nil && be != nil:
+			if !equal(ae.value, be.value) {
+				changed = append(changed, Change[V]{Prefix: ae.prefix, Old: ae.value, New: be.value})
+			}
+		case ae != nil:
+			removed = append(removed, ae.prefix)
+		default:
+			added = append(added, be.prefix)
+		}
+		return true
+	})
+	return added, removed, changed
 }
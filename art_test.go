@@ -6,9 +6,12 @@
 package art
 
 import (
+	"iter"
 	"math/rand"
 	"net"
 	"reflect"
+	"sync"
+	"sync/atomic"
 	"testing"
 
 	"inet.af/netaddr"
@@ -63,29 +66,23 @@ func (r route4b) IPPrefix() netaddr.IPPrefix {
 	)
 }
 
-func (r route4b) Equals(other Route) bool {
-	r4b, ok := other.(route4b)
-	return ok && r == r4b
+func newSingleLevelTestTable() *Table[int] {
+	return NewTable[int]([]int{4})
 }
 
-func newSingleLevelTestTable() *Table {
-	return NewTable([]int{4})
-}
-
-var _ Route = route4b{}
-
 func TestInsertSingleLevel(t *testing.T) {
 	x := newSingleLevelTestTable()
 
 	// Figure 3-1.
 	r1 := route4b{12, 2}
-	if !x.Insert(r1) {
+	if !x.Insert(r1.IPPrefix(), 1) {
 		t.Errorf("insert %v failed", r1)
 	}
+	e1 := x.root.r[7]
 	want := newSingleLevelTestTable()
-	want.root.ref++
+	want.root.routeRefs++
 	for _, i := range []int{7, 14, 15, 28, 29, 30, 31} {
-		want.root.r[i] = r1
+		want.root.r[i] = e1
 	}
 	if !reflect.DeepEqual(x.root, want.root) {
 		t.Errorf("wrong after 1st step\n got: %v\nwant: %v\n", x.root, want.root)
@@ -93,25 +90,27 @@ func TestInsertSingleLevel(t *testing.T) {
 
 	// Figure 3-2. ("Now assume we insert a route to prefix 14/3")
 	r2 := route4b{14, 3}
-	if !x.Insert(r2) {
+	if !x.Insert(r2.IPPrefix(), 2) {
 		t.Errorf("insert %v failed", r2)
 	}
+	e2 := x.root.r[15]
 	for _, i := range []int{15, 30, 31} {
-		want.root.r[i] = r2
+		want.root.r[i] = e2
 	}
-	want.root.ref++
+	want.root.routeRefs++
 	if !reflect.DeepEqual(x, want) {
 		t.Errorf("wrong after 2nd step\n got: %v\nwant: %v\n", x, want)
 	}
 
 	// Figure 3-3. ("Now assume we insert a route to prefix 8/1")
 	r3 := route4b{8, 1}
-	if !x.Insert(r3) {
+	if !x.Insert(r3.IPPrefix(), 3) {
 		t.Errorf("insert %v failed", r3)
 	}
-	want.root.ref++
+	e3 := x.root.r[3]
+	want.root.routeRefs++
 	for _, i := range []int{3, 6, 12, 13, 24, 25, 26, 27} {
-		want.root.r[i] = r3
+		want.root.r[i] = e3
 	}
 	if !reflect.DeepEqual(x.root, want.root) {
 		t.Errorf("wrong after 3rd step\n got: %v\nwant: %v\n", x.root, want.root)
@@ -119,11 +118,11 @@ func TestInsertSingleLevel(t *testing.T) {
 }
 
 // testTable returns the example table set up before section 2.1.2 of the paper.
-func testTable() *Table {
+func testTable() *Table[int] {
 	x := newSingleLevelTestTable()
-	x.Insert(route4b{12, 2})
-	x.Insert(route4b{14, 3})
-	x.Insert(route4b{8, 1})
+	x.Insert(route4b{12, 2}.IPPrefix(), 12)
+	x.Insert(route4b{14, 3}.IPPrefix(), 14)
+	x.Insert(route4b{8, 1}.IPPrefix(), 8)
 	return x
 }
 
@@ -131,25 +130,30 @@ func TestLookupSingleLevel(t *testing.T) {
 	x := testTable()
 	for _, tt := range []struct {
 		addr uint32
-		want Route
+		want int
+		ok   bool
 	}{
-		{0, nil},
-		{1, nil},
+		{0, 0, false},
+		{1, 0, false},
 		// ...
-		{6, nil},
-		{7, nil},
-		{8, route4b{8, 1}},
-		{9, route4b{8, 1}},
-		{10, route4b{8, 1}},
-		{11, route4b{8, 1}},
-		{12, route4b{12, 2}},
-		{13, route4b{12, 2}},
-		{14, route4b{14, 3}},
-		{15, route4b{14, 3}},
+		{6, 0, false},
+		{7, 0, false},
+		{8, 8, true},
+		{9, 8, true},
+		{10, 8, true},
+		{11, 8, true},
+		{12, 12, true},
+		{13, 12, true},
+		{14, 14, true},
+		{15, 14, true},
 	} {
-		got, _ := x.root.lookupSingle(4, tt.addr)
-		if got != tt.want {
-			t.Errorf("lookup(addr=%v) = %v; want %v", tt.addr, got, tt.want)
+		got, ok := x.root.lookupSingle(4, tt.addr)
+		if ok != tt.ok {
+			t.Errorf("lookup(addr=%v) ok = %v; want %v", tt.addr, ok, tt.ok)
+			continue
+		}
+		if ok && got.value != tt.want {
+			t.Errorf("lookup(addr=%v) = %v; want %v", tt.addr, got.value, tt.want)
 		}
 	}
 }
@@ -160,7 +164,7 @@ func TestDeleteSingleLevel(t *testing.T) {
 	if !ok {
 		t.Fatal("didn't delete")
 	}
-	if want := (route4b{12, 2}); old != want {
+	if want := 12; old != want {
 		t.Fatalf("deleted %v; want %v", old, want)
 	}
 
@@ -174,47 +178,37 @@ func TestDeleteSingleLevel(t *testing.T) {
 	if !ok {
 		t.Fatal("didn't delete")
 	}
-	if want := (route4b{8, 1}); old != want {
+	if want := 8; old != want {
 		t.Fatalf("deleted %v; want %v", old, want)
 	}
 	want := testTable()
-	want.root.r = []Route{
-		7:  route4b{12, 2},
-		14: route4b{12, 2},
-		28: route4b{12, 2},
-		29: route4b{12, 2},
-		15: route4b{14, 3},
-		30: route4b{14, 3},
-		31: route4b{14, 3},
-	}
-	want.root.ref--
+	e12 := want.root.r[7]
+	e14 := want.root.r[15]
+	want.root.r = []*entry[int]{
+		7:  e12,
+		14: e12,
+		28: e12,
+		29: e12,
+		15: e14,
+		30: e14,
+		31: e14,
+	}
+	want.root.routeRefs--
 	if !reflect.DeepEqual(x, want) {
 		t.Errorf("not like Figure 3-2:\n got: %v\nwant: %v\n", x.root, want.root)
 	}
 }
 
-func newIPv4Table_8() *Table {
-	return NewTable([]int{8, 8, 8, 8})
-}
-
-func newIPv4Table_16_8() *Table {
-	return NewTable([]int{16, 8, 8})
+func newIPv4Table_8() *Table[int] {
+	return NewTable[int]([]int{8, 8, 8, 8})
 }
 
-type testRoute struct {
-	ipp netaddr.IPPrefix
-	val interface{}
+func newIPv4Table_16_8() *Table[int] {
+	return NewTable[int]([]int{16, 8, 8})
 }
 
-func (tr testRoute) IPPrefix() netaddr.IPPrefix { return tr.ipp }
-
-func (tr testRoute) Equals(r Route) bool {
-	tr2, ok := r.(testRoute)
-	return ok && tr2.val == tr.val && tr.ipp == tr2.ipp
-}
-
-func genTestRoutes(width, num int) []Route {
-	var routes []Route
+func genTestRoutes(width, num int) []netaddr.IPPrefix {
+	var prefixes []netaddr.IPPrefix
 	rand.Seed(1)
 	ipps := map[netaddr.IPPrefix]bool{}
 	bytesPer := 16
@@ -227,7 +221,7 @@ func genTestRoutes(width, num int) []Route {
 			length := uint8(rand.Intn(width + 1))
 			addr := make([]byte, bytesPer)
 			for pl := 0; pl < int(length); pl++ {
-				addr[pl/8] |= byte(rand.Intn(2)) << (pl % 8)
+				addr[pl/8] |= byte(rand.Intn(2)) << (7 - pl%8)
 			}
 			ip, ok := netaddr.FromStdIP(net.IP(addr))
 			if !ok {
@@ -240,36 +234,35 @@ func genTestRoutes(width, num int) []Route {
 			ipps[ipp] = true
 			break
 		}
-		routes = append(routes, testRoute{ipp, i})
+		prefixes = append(prefixes, ipp)
 	}
-	return routes
+	return prefixes
 }
 
 func TestInsertDeleteSingle4bit(t *testing.T) {
-	routes := genTestRoutes(4, 20)
+	prefixes := genTestRoutes(4, 20)
 	for i := 0; i < 2000; i++ {
-		rand.Shuffle(len(routes), func(i, j int) {
-			routes[i], routes[j] = routes[j], routes[i]
+		rand.Shuffle(len(prefixes), func(i, j int) {
+			prefixes[i], prefixes[j] = prefixes[j], prefixes[i]
 		})
 		x := newSingleLevelTestTable()
-		for i, r := range routes {
+		for i, ipp := range prefixes {
 			preInsert := x.Clone()
-			if !x.Insert(r) {
-				t.Fatalf("failed to insert %d, %+v", i, r)
+			if !x.Insert(ipp, i) {
+				t.Fatalf("failed to insert %d, %+v", i, ipp)
 			}
-			ipp := r.IPPrefix()
 			del, ok := x.Delete(ipp)
 			if !ok {
 				t.Fatalf("failed to delete %d, %+v", i, ipp)
 			}
-			if !del.Equals(r) {
-				t.Fatalf("delete of %d deleted %v, want %v", i, del, r)
+			if del != i {
+				t.Fatalf("delete of %d deleted %v, want %v", i, del, i)
 			}
 			if !reflect.DeepEqual(x, preInsert) {
 				t.Fatalf("delete of %d (%+v) didn't return table to prior state\n now: %v\n was: %v\n", i, ipp, x, preInsert)
 			}
-			if !x.Insert(r) {
-				t.Fatalf("failed to re-insert %d, %+v", i, r)
+			if !x.Insert(ipp, i) {
+				t.Fatalf("failed to re-insert %d, %+v", i, ipp)
 			}
 		}
 	}
@@ -284,8 +277,8 @@ func TestMultiIPv4_stride16_8(t *testing.T) {
 }
 
 func TestMultiIPv6_stride8(t *testing.T) {
-	testMulti(t, func() *Table {
-		return NewTable([]int{
+	testMulti(t, func() *Table[int] {
+		return NewTable[int]([]int{
 			8, 8, 8, 8,
 			8, 8, 8, 8,
 			8, 8, 8, 8,
@@ -294,25 +287,24 @@ func TestMultiIPv6_stride8(t *testing.T) {
 	}, 128)
 }
 
-func testMulti(t *testing.T, newTable func() *Table, width int) {
-	routes := genTestRoutes(width, 100)
+func testMulti(t *testing.T, newTable func() *Table[int], width int) {
+	prefixes := genTestRoutes(width, 100)
 	numShuffle := 10
 	if testing.Short() {
 		numShuffle = 2
 	}
 
 	for i := 0; i < numShuffle; i++ {
-		rand.Shuffle(len(routes), func(i, j int) {
-			routes[i], routes[j] = routes[j], routes[i]
+		rand.Shuffle(len(prefixes), func(i, j int) {
+			prefixes[i], prefixes[j] = prefixes[j], prefixes[i]
 		})
 		x := newTable()
-		for i, r := range routes {
-			ipp := r.IPPrefix()
-			gotBefore, _ := x.Lookup(ipp.IP())
+		for i, ipp := range prefixes {
+			beforeVal, beforeOK := x.Lookup(ipp.IP())
 
 			preInsert := x.Clone()
-			if !x.Insert(r) {
-				t.Fatalf("failed to insert %d, %+v", i, r)
+			if !x.Insert(ipp, i) {
+				t.Fatalf("failed to insert %d, %+v", i, ipp)
 			}
 
 			got, ok := x.Lookup(ipp.IP())
@@ -320,11 +312,11 @@ func testMulti(t *testing.T, newTable func() *Table, width int) {
 				t.Fatalf("i=%d; Lookup(%v) failed (%+v)", i, ipp.IP(), ipp)
 			}
 
-			want := r
-			if gotBefore != nil && gotBefore.(testRoute).ipp.Bits() > ipp.Bits() {
-				want = gotBefore
+			want := i
+			if beforeOK && prefixes[beforeVal].Bits() > ipp.Bits() {
+				want = beforeVal
 			}
-			if !got.Equals(want) {
+			if got != want {
 				t.Fatalf("i=%d; Lookup(%v) got %v; want %v", i, ipp.IP(), got, want)
 			}
 
@@ -332,30 +324,30 @@ func testMulti(t *testing.T, newTable func() *Table, width int) {
 			if !ok {
 				t.Fatalf("failed to delete %d, %+v", i, ipp)
 			}
-			if !del.Equals(r) {
-				t.Fatalf("delete of %d deleted %v, want %v", i, del, r)
+			if del != i {
+				t.Fatalf("delete of %d deleted %v, want %v", i, del, i)
 			}
 			if !reflect.DeepEqual(x, preInsert) {
 				t.Fatalf("delete of %d (%+v) didn't return table to prior state\n now: %v\n was: %v\n", i, ipp, x, preInsert)
 			}
-			if !x.Insert(r) {
-				t.Fatalf("failed to re-insert %d, %+v", i, r)
+			if !x.Insert(ipp, i) {
+				t.Fatalf("failed to re-insert %d, %+v", i, ipp)
 			}
 		}
 	}
 }
 
-func benchInsertRemoveIPv4(b *testing.B, newTable func() *Table) {
+func benchInsertRemoveIPv4(b *testing.B, newTable func() *Table[int]) {
 	t := newTable()
 	b.ReportAllocs()
 	uniq := 100
-	routes := genTestRoutes(32, uniq)
+	prefixes := genTestRoutes(32, uniq)
 	for i := 0; i < b.N; i++ {
-		v := routes[i%uniq]
-		if !t.Insert(v) {
+		ipp := prefixes[i%uniq]
+		if !t.Insert(ipp, i) {
 			b.Error("Insertion failed")
 		}
-		if _, ok := t.Delete(v.IPPrefix()); !ok {
+		if _, ok := t.Delete(ipp); !ok {
 			b.Error("Removal failed")
 		}
 	}
@@ -379,20 +371,404 @@ func BenchmarkMultiIPv4_stride16_8(b *testing.B) {
 	})
 }
 
-func benchSearchIPv4(b *testing.B, newTable func() *Table) {
+func benchSearchIPv4(b *testing.B, newTable func() *Table[int]) {
 	t := newTable()
 	uniq := 100
-	routes := genTestRoutes(32, 100)
-	for _, route := range routes {
-		if !t.Insert(route) {
+	prefixes := genTestRoutes(32, 100)
+	for i, ipp := range prefixes {
+		if !t.Insert(ipp, i) {
 			b.Error("Insertion failed")
 		}
 	}
 	b.ReportAllocs()
 	for i := 0; i < b.N; i++ {
-		v := routes[i%uniq]
-		if _, ok := t.Lookup(v.IPPrefix().IP()); !ok {
+		ipp := prefixes[i%uniq]
+		if _, ok := t.Lookup(ipp.IP()); !ok {
 			b.Error("Lookup failed")
 		}
 	}
 }
+
+// TestPathCompressionSplitOnStrideBoundary covers the case the uncompressed implementation
+// never exercised: two routes whose first divergent bit falls exactly splitStride bits below
+// where they first collided, forcing insertCompressed's width calculation to fall back to its
+// "+1" default (rather than pin to one route's remaining length) right at a splitStride
+// boundary.
+func TestPathCompressionSplitOnStrideBoundary(t *testing.T) {
+	x := newIPv4Table_8()
+
+	a := netaddr.MustParseIPPrefix("10.0.0.1/32")   // third octet 00000000
+	b := netaddr.MustParseIPPrefix("10.0.128.1/32") // third octet 10000000: diverges at bit 16
+
+	if !x.Insert(a, 1) {
+		t.Fatal("insert a failed")
+	}
+	if !x.Insert(b, 2) {
+		t.Fatal("insert b failed")
+	}
+
+	if got, ok := x.Lookup(a.IP()); !ok || got != 1 {
+		t.Errorf("Lookup(a) = %v, %v; want 1, true", got, ok)
+	}
+	if got, ok := x.Lookup(b.IP()); !ok || got != 2 {
+		t.Errorf("Lookup(b) = %v, %v; want 2, true", got, ok)
+	}
+
+	if del, ok := x.Delete(a); !ok || del != 1 {
+		t.Fatalf("Delete(a) = %v, %v; want 1, true", del, ok)
+	}
+	if got, ok := x.Lookup(b.IP()); !ok || got != 2 {
+		t.Errorf("after delete, Lookup(b) = %v, %v; want 2, true", got, ok)
+	}
+	if _, ok := x.Lookup(a.IP()); ok {
+		t.Errorf("after delete, Lookup(a) unexpectedly found a route")
+	}
+}
+
+// TestPathCompressionParentChild covers the other case the uncompressed implementation never
+// exercised: a route and a more specific subnet of it sharing a compressed slot, inserted in
+// both orders. Either order must end up with the same lookup behavior: IPs under the child
+// subnet resolve to the child, everything else under the parent resolves to the parent.
+func TestPathCompressionParentChild(t *testing.T) {
+	parent := netaddr.MustParseIPPrefix("10.1.0.0/16")
+	child := netaddr.MustParseIPPrefix("10.1.2.0/24")
+	inOnly, inChild := netaddr.MustParseIP("10.1.0.5"), netaddr.MustParseIP("10.1.2.7")
+
+	check := func(t *testing.T, x *Table[int]) {
+		t.Helper()
+		if got, ok := x.Lookup(inOnly); !ok || got != 1 {
+			t.Errorf("Lookup(%v) = %v, %v; want 1, true", inOnly, got, ok)
+		}
+		if got, ok := x.Lookup(inChild); !ok || got != 2 {
+			t.Errorf("Lookup(%v) = %v, %v; want 2, true", inChild, got, ok)
+		}
+	}
+
+	t.Run("parent_then_child", func(t *testing.T) {
+		x := newIPv4Table_8()
+		if !x.Insert(parent, 1) {
+			t.Fatal("insert parent failed")
+		}
+		if !x.Insert(child, 2) {
+			t.Fatal("insert child failed")
+		}
+		check(t, x)
+	})
+
+	t.Run("child_then_parent", func(t *testing.T) {
+		x := newIPv4Table_8()
+		if !x.Insert(child, 2) {
+			t.Fatal("insert child failed")
+		}
+		if !x.Insert(parent, 1) {
+			t.Fatal("insert parent failed")
+		}
+		check(t, x)
+	})
+}
+
+// TestPersistentMatchesMutating inserts and deletes the same routes via the persistent and
+// mutating APIs in parallel and checks they agree at every step, and that InsertPersistent and
+// DeletePersistent never modify the table version they were called on.
+func TestPersistentMatchesMutating(t *testing.T) {
+	prefixes := genTestRoutes(32, 200)
+
+	mutating := newIPv4Table_8()
+	persistent := newIPv4Table_8()
+	for i, ipp := range prefixes {
+		before := persistent.Clone()
+
+		if !mutating.Insert(ipp, i) {
+			t.Fatalf("mutating insert of %d (%v) failed", i, ipp)
+		}
+		next, ok := persistent.InsertPersistent(ipp, i)
+		if !ok {
+			t.Fatalf("persistent insert of %d (%v) failed", i, ipp)
+		}
+		if !reflect.DeepEqual(persistent, before) {
+			t.Fatalf("InsertPersistent mutated its receiver")
+		}
+		persistent = next
+
+		for _, ipp := range prefixes[:i+1] {
+			mv, mok := mutating.Lookup(ipp.IP())
+			pv, pok := persistent.Lookup(ipp.IP())
+			if mv != pv || mok != pok {
+				t.Fatalf("Lookup(%v) mismatch after inserting %d: mutating=(%v,%v) persistent=(%v,%v)", ipp.IP(), i, mv, mok, pv, pok)
+			}
+		}
+	}
+
+	for i, ipp := range prefixes {
+		before := persistent.Clone()
+
+		mdel, mok := mutating.Delete(ipp)
+		next, pdel, pok := persistent.DeletePersistent(ipp)
+		if mok != pok || mdel != pdel {
+			t.Fatalf("Delete(%d, %v) mismatch: mutating=(%v,%v) persistent=(%v,%v)", i, ipp, mdel, mok, pdel, pok)
+		}
+		if !reflect.DeepEqual(persistent, before) {
+			t.Fatalf("DeletePersistent mutated its receiver")
+		}
+		persistent = next
+
+		mv, mok := mutating.Lookup(ipp.IP())
+		pv, pok := persistent.Lookup(ipp.IP())
+		if mv != pv || mok != pok {
+			t.Fatalf("Lookup(%v) mismatch after deleting %d: mutating=(%v,%v) persistent=(%v,%v)", ipp.IP(), i, mv, mok, pv, pok)
+		}
+	}
+}
+
+// BenchmarkConcurrentLookup compares concurrent read throughput between the mutating Table,
+// where readers must share a lock with an active writer, and the persistent API, where readers
+// always read an already-published, immutable snapshot while a writer produces new versions
+// with InsertPersistent/DeletePersistent.
+func BenchmarkConcurrentLookup(b *testing.B) {
+	uniq := 100
+	prefixes := genTestRoutes(32, uniq)
+
+	b.Run("MutexGuarded", func(b *testing.B) {
+		t := newIPv4Table_8()
+		for i, ipp := range prefixes {
+			t.Insert(ipp, i)
+		}
+
+		var mu sync.RWMutex
+		stop := make(chan struct{})
+		defer close(stop)
+		go func() {
+			for i := 0; ; i++ {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				ipp := prefixes[i%uniq]
+				mu.Lock()
+				t.Delete(ipp)
+				t.Insert(ipp, i)
+				mu.Unlock()
+			}
+		}()
+
+		b.ReportAllocs()
+		b.ResetTimer()
+		b.RunParallel(func(pb *testing.PB) {
+			for i := 0; pb.Next(); i++ {
+				ipp := prefixes[i%uniq]
+				mu.RLock()
+				t.Lookup(ipp.IP())
+				mu.RUnlock()
+			}
+		})
+	})
+
+	b.Run("Persistent", func(b *testing.B) {
+		t := newIPv4Table_8()
+		for i, ipp := range prefixes {
+			t.Insert(ipp, i)
+		}
+		var cur atomic.Pointer[Table[int]]
+		cur.Store(t)
+
+		stop := make(chan struct{})
+		defer close(stop)
+		go func() {
+			for i := 0; ; i++ {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				ipp := prefixes[i%uniq]
+				snap := cur.Load()
+				next, _, _ := snap.DeletePersistent(ipp)
+				next, _ = next.InsertPersistent(ipp, i)
+				cur.Store(next)
+			}
+		}()
+
+		b.ReportAllocs()
+		b.ResetTimer()
+		b.RunParallel(func(pb *testing.PB) {
+			for i := 0; pb.Next(); i++ {
+				ipp := prefixes[i%uniq]
+				cur.Load().Lookup(ipp.IP())
+			}
+		})
+	})
+}
+
+func collectWalk[V any](x *Table[V]) map[netaddr.IPPrefix]V {
+	got := map[netaddr.IPPrefix]V{}
+	x.Walk(func(prefix netaddr.IPPrefix, value V) bool {
+		got[prefix] = value
+		return true
+	})
+	return got
+}
+
+// TestWalk checks that Walk visits every inserted route exactly once, deduplicating the copies
+// the allotment scheme propagates into covered r slots, including across the path-compressed and
+// split nodes a sparse multi-level table produces.
+func TestWalk(t *testing.T) {
+	x := newIPv4Table_8()
+	routes := map[netaddr.IPPrefix]int{}
+	for i, ipp := range genTestRoutes(32, 50) {
+		if !x.Insert(ipp, i) {
+			t.Fatalf("insert %d (%v) failed", i, ipp)
+		}
+		routes[ipp] = i
+	}
+
+	got := collectWalk(x)
+	if !reflect.DeepEqual(got, routes) {
+		t.Fatalf("Walk = %v; want %v", got, routes)
+	}
+}
+
+// TestSupernetsSubnets checks Supernets and Subnets against a small hand-built hierarchy of
+// nested prefixes, including a default route and a prefix with no relatives in the table.
+func TestSupernetsSubnets(t *testing.T) {
+	x := newIPv4Table_8()
+	routes := []struct {
+		ipp netaddr.IPPrefix
+		v   int
+	}{
+		{netaddr.MustParseIPPrefix("0.0.0.0/0"), 0},
+		{netaddr.MustParseIPPrefix("10.0.0.0/8"), 1},
+		{netaddr.MustParseIPPrefix("10.1.0.0/16"), 2},
+		{netaddr.MustParseIPPrefix("10.1.2.0/24"), 3},
+		{netaddr.MustParseIPPrefix("10.1.2.0/25"), 4},
+		{netaddr.MustParseIPPrefix("172.16.0.0/12"), 5},
+	}
+	for _, r := range routes {
+		if !x.Insert(r.ipp, r.v) {
+			t.Fatalf("insert %v failed", r.ipp)
+		}
+	}
+
+	collect := func(seq iter.Seq2[netaddr.IPPrefix, int]) map[netaddr.IPPrefix]int {
+		got := map[netaddr.IPPrefix]int{}
+		for ipp, v := range seq {
+			got[ipp] = v
+		}
+		return got
+	}
+
+	tests := []struct {
+		name      string
+		prefix    netaddr.IPPrefix
+		supernets map[netaddr.IPPrefix]int
+		subnets   map[netaddr.IPPrefix]int
+	}{
+		{
+			name:   "mid_tree",
+			prefix: netaddr.MustParseIPPrefix("10.1.2.0/24"),
+			supernets: map[netaddr.IPPrefix]int{
+				netaddr.MustParseIPPrefix("0.0.0.0/0"):   0,
+				netaddr.MustParseIPPrefix("10.0.0.0/8"):  1,
+				netaddr.MustParseIPPrefix("10.1.0.0/16"): 2,
+				netaddr.MustParseIPPrefix("10.1.2.0/24"): 3,
+			},
+			subnets: map[netaddr.IPPrefix]int{
+				netaddr.MustParseIPPrefix("10.1.2.0/24"): 3,
+				netaddr.MustParseIPPrefix("10.1.2.0/25"): 4,
+			},
+		},
+		{
+			name:   "unrelated",
+			prefix: netaddr.MustParseIPPrefix("192.168.0.0/16"),
+			supernets: map[netaddr.IPPrefix]int{
+				netaddr.MustParseIPPrefix("0.0.0.0/0"): 0,
+			},
+			subnets: map[netaddr.IPPrefix]int{},
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := collect(x.Supernets(tc.prefix)); !reflect.DeepEqual(got, tc.supernets) {
+				t.Errorf("Supernets(%v) = %v; want %v", tc.prefix, got, tc.supernets)
+			}
+			if got := collect(x.Subnets(tc.prefix)); !reflect.DeepEqual(got, tc.subnets) {
+				t.Errorf("Subnets(%v) = %v; want %v", tc.prefix, got, tc.subnets)
+			}
+		})
+	}
+}
+
+func TestUnionIntersectDiff(t *testing.T) {
+	shared := netaddr.MustParseIPPrefix("10.0.0.0/8")
+	onlyX := netaddr.MustParseIPPrefix("10.1.0.0/16")
+	onlyY := netaddr.MustParseIPPrefix("172.16.0.0/12")
+	changed := netaddr.MustParseIPPrefix("192.168.0.0/16")
+
+	x := newIPv4Table_8()
+	x.Insert(shared, 1)
+	x.Insert(onlyX, 2)
+	x.Insert(changed, 3)
+
+	y := newIPv4Table_8()
+	y.Insert(shared, 1)
+	y.Insert(onlyY, 4)
+	y.Insert(changed, 30)
+
+	union := x.Union(y, func(a, b int) int { return a + b })
+	wantUnion := map[netaddr.IPPrefix]int{shared: 2, onlyX: 2, onlyY: 4, changed: 33}
+	if got := collectWalk(union); !reflect.DeepEqual(got, wantUnion) {
+		t.Errorf("Union = %v; want %v", got, wantUnion)
+	}
+
+	intersect := x.Intersect(y)
+	wantIntersect := map[netaddr.IPPrefix]int{shared: 1, changed: 3}
+	if got := collectWalk(intersect); !reflect.DeepEqual(got, wantIntersect) {
+		t.Errorf("Intersect = %v; want %v", got, wantIntersect)
+	}
+
+	added, removed, diffChanged := x.Diff(y, func(a, b int) bool { return a == b })
+	if want := []netaddr.IPPrefix{onlyY}; !reflect.DeepEqual(added, want) {
+		t.Errorf("Diff added = %v; want %v", added, want)
+	}
+	if want := []netaddr.IPPrefix{onlyX}; !reflect.DeepEqual(removed, want) {
+		t.Errorf("Diff removed = %v; want %v", removed, want)
+	}
+	if want := []Change[int]{{Prefix: changed, Old: 3, New: 30}}; !reflect.DeepEqual(diffChanged, want) {
+		t.Errorf("Diff changed = %v; want %v", diffChanged, want)
+	}
+}
+
+// TestUnionIntersectDiffCompressed covers pairedWalk's fallback path: the two tables' routes
+// collide into path-compressed leaves at different depths on each side (x's third and fourth
+// octets never diverge into real nodes, y's do), so the shapes being paired up don't line up
+// slot-by-slot below the tables' configured strides.
+func TestUnionIntersectDiffCompressed(t *testing.T) {
+	shared := netaddr.MustParseIPPrefix("10.1.2.3/32")
+	onlyX := netaddr.MustParseIPPrefix("10.1.2.4/32")
+	onlyY := netaddr.MustParseIPPrefix("10.1.2.5/32")
+
+	x := newIPv4Table_8()
+	x.Insert(shared, 1)
+	x.Insert(onlyX, 2)
+
+	y := newIPv4Table_8()
+	y.Insert(shared, 10)
+	y.Insert(onlyY, 3)
+	y.Insert(netaddr.MustParseIPPrefix("10.1.2.0/24"), 4) // forces y's third-octet split
+
+	union := x.Union(y, func(a, b int) int { return a + b })
+	wantUnion := map[netaddr.IPPrefix]int{
+		shared: 11, onlyX: 2, onlyY: 3,
+		netaddr.MustParseIPPrefix("10.1.2.0/24"): 4,
+	}
+	if got := collectWalk(union); !reflect.DeepEqual(got, wantUnion) {
+		t.Errorf("Union = %v; want %v", got, wantUnion)
+	}
+
+	intersect := x.Intersect(y)
+	wantIntersect := map[netaddr.IPPrefix]int{shared: 1}
+	if got := collectWalk(intersect); !reflect.DeepEqual(got, wantIntersect) {
+		t.Errorf("Intersect = %v; want %v", got, wantIntersect)
+	}
+}